@@ -0,0 +1,136 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package presence
+
+import (
+	"time"
+
+	gozk "launchpad.net/gozk/zookeeper"
+)
+
+// NewGozkConn adapts conn, and the session-event channel returned
+// alongside it by gozk.Dial, to the Conn interface, returning a
+// SessionWatch that every consumer sharing conn can subscribe to in its
+// own right. It is the adapter presence has always run against; NewZkConn
+// is the alternative for the github.com/samuel/go-zookeeper/zk client.
+func NewGozkConn(conn *gozk.Conn, nativeSession <-chan gozk.Event) (Conn, *SessionWatch) {
+	translated := make(chan Event)
+	go func() {
+		defer close(translated)
+		for ev := range nativeSession {
+			translated <- gozkEvent(ev)
+		}
+	}()
+	return gozkConn{conn}, newSessionWatch(translated)
+}
+
+type gozkConn struct {
+	conn *gozk.Conn
+}
+
+func (c gozkConn) Get(path string) (string, Stat, error) {
+	content, stat, err := c.conn.Get(path)
+	return content, gozkStatOrNil(stat), gozkErr(err)
+}
+
+func (c gozkConn) GetW(path string) (string, Stat, <-chan Event, error) {
+	content, stat, zkWatch, err := c.conn.GetW(path)
+	return content, gozkStatOrNil(stat), gozkWatch(zkWatch), gozkErr(err)
+}
+
+func (c gozkConn) ExistsW(path string) (Stat, <-chan Event, error) {
+	stat, zkWatch, err := c.conn.ExistsW(path)
+	return gozkStatOrNil(stat), gozkWatch(zkWatch), gozkErr(err)
+}
+
+func (c gozkConn) Set(path, content string, version int32) (Stat, error) {
+	stat, err := c.conn.Set(path, content, int(version))
+	return gozkStatOrNil(stat), gozkErr(err)
+}
+
+func (c gozkConn) Create(path, content string, flags int32) (string, error) {
+	newPath, err := c.conn.Create(path, content, int(flags), gozk.WorldACL(gozk.PERM_ALL))
+	return newPath, gozkErr(err)
+}
+
+func (c gozkConn) Delete(path string, version int32) error {
+	return gozkErr(c.conn.Delete(path, int(version)))
+}
+
+// gozkStat adapts a *gozk.Stat to the Stat interface.
+type gozkStat struct {
+	stat *gozk.Stat
+}
+
+func (s gozkStat) MTime() time.Time {
+	return s.stat.MTime()
+}
+
+func (s gozkStat) EphemeralOwner() int64 {
+	return s.stat.EphemeralOwner()
+}
+
+// gozkStatOrNil wraps stat in a gozkStat, unless stat itself is nil -- as
+// gozk represents a missing node -- in which case it returns a nil Stat
+// rather than a non-nil interface wrapping a nil pointer.
+func gozkStatOrNil(stat *gozk.Stat) Stat {
+	if stat == nil {
+		return nil
+	}
+	return gozkStat{stat}
+}
+
+// gozkWatch adapts a single-fire gozk watch channel to one delivering
+// presence Events, translating each event with gozkEvent and closing
+// watch once zkWatch is closed. watch is given a buffer of 1 so that the
+// goroutine below can deliver its one event and exit even if presence
+// abandons the watch without ever reading it -- as it does on the "node
+// *just* appeared" retry in newStateW -- rather than leaking forever on an
+// unbuffered send nobody is there to receive.
+func gozkWatch(zkWatch <-chan gozk.Event) <-chan Event {
+	if zkWatch == nil {
+		return nil
+	}
+	watch := make(chan Event, 1)
+	go func() {
+		defer close(watch)
+		for ev := range zkWatch {
+			watch <- gozkEvent(ev)
+		}
+	}()
+	return watch
+}
+
+func gozkEvent(ev gozk.Event) Event {
+	e := Event{}
+	switch ev.Type {
+	case gozk.EVENT_CREATED:
+		e.Type = EventCreated
+	case gozk.EVENT_CHANGED:
+		e.Type = EventChanged
+	case gozk.EVENT_DELETED:
+		e.Type = EventDeleted
+	case gozk.EVENT_SESSION:
+		e.Type = EventSession
+	}
+	switch ev.State {
+	case gozk.STATE_CONNECTING:
+		e.State = SessionConnecting
+	case gozk.STATE_EXPIRED_SESSION:
+		e.State = SessionExpired
+	default:
+		e.State = SessionConnected
+	}
+	return e
+}
+
+func gozkErr(err error) error {
+	switch err {
+	case gozk.ZNONODE:
+		return ErrNoNode
+	case gozk.ZNODEEXISTS:
+		return ErrNodeExists
+	}
+	return err
+}
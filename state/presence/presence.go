@@ -1,14 +1,18 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
 package presence
 
 import (
 	"fmt"
-	zk "launchpad.net/gozk/zookeeper"
 	"time"
+
+	"launchpad.net/tomb"
 )
 
 // changeNode wraps a zookeeper node and can induce watches on that node to fire.
 type changeNode struct {
-	conn    *zk.Conn
+	conn    Conn
 	path    string
 	content string
 }
@@ -18,9 +22,9 @@ type changeNode struct {
 // in addition to its primary purpose of triggering watches on the node.
 func (n *changeNode) change() (mtime time.Time, err error) {
 	stat, err := n.conn.Set(n.path, n.content, -1)
-	if err == zk.ZNONODE {
-		_, err = n.conn.Create(n.path, n.content, 0, zk.WorldACL(zk.PERM_ALL))
-		if err == nil || err == zk.ZNODEEXISTS {
+	if err == ErrNoNode {
+		_, err = n.conn.Create(n.path, n.content, 0)
+		if err == nil || err == ErrNodeExists {
 			// *Someone* created the node anyway; just try again.
 			return n.change()
 		}
@@ -31,24 +35,43 @@ func (n *changeNode) change() (mtime time.Time, err error) {
 	return stat.MTime(), nil
 }
 
+// sessionLost reports whether event represents the connection's session
+// being unusable for further writes: either reconnecting from scratch, or
+// having had its session expired outright. Other session events (such as
+// a plain SessionConnected) do not count.
+func sessionLost(event Event) bool {
+	return event.Type == EventSession && !event.Ok()
+}
+
 // Pinger continually updates a node in zookeeper when run.
 type Pinger struct {
-	conn    *zk.Conn
-	target  changeNode
-	period  time.Duration
-	closing chan bool
+	tomb.Tomb
+	conn       Conn
+	target     changeNode
+	period     time.Duration
+	sessionSub *Subscription
 }
 
-// run calls change on p.target every p.period nanoseconds until p is closed.
-func (p *Pinger) run() {
+// loop calls change on p.target every p.period nanoseconds until p is killed,
+// or until the session watch reports that the connection can no longer be
+// relied upon to keep the node alive.
+func (p *Pinger) loop() {
+	defer p.Done()
+	defer p.sessionSub.Close()
+	tick := time.NewTicker(p.period)
+	defer tick.Stop()
 	for {
 		select {
-		case <-p.closing:
+		case <-p.Dying():
 			return
-		case <-time.After(p.period):
-			_, err := p.target.change()
-			if err != nil {
-				<-p.closing
+		case event, ok := <-p.sessionSub.Events():
+			if !ok || sessionLost(event) {
+				p.Tomb.Kill(fmt.Errorf("presence: zookeeper session lost: %v", event))
+				return
+			}
+		case <-tick.C:
+			if _, err := p.target.change(); err != nil {
+				p.Tomb.Kill(err)
 				return
 			}
 		}
@@ -57,66 +80,116 @@ func (p *Pinger) run() {
 
 // Close stops updating the node; AliveW watches will not notice any change
 // until they time out. A final write to the node is triggered to ensure
-// watchers time out as late as possible.
-func (p *Pinger) Close() {
-	p.closing <- true
+// watchers time out as late as possible. Close returns any error that
+// caused the Pinger to stop running on its own, such as a lost session.
+func (p *Pinger) Close() error {
+	p.Tomb.Kill(nil)
+	err := p.Tomb.Wait()
 	p.target.change()
+	return err
 }
 
 // Kill stops updating and deletes the node, causing any AliveW watches
-// to observe its departure (almost) immediately.
-func (p *Pinger) Kill() {
-	p.closing <- true
+// to observe its departure (almost) immediately. Kill returns any error
+// that caused the Pinger to stop running on its own, such as a lost
+// session; in that case the delete is best-effort, since the session that
+// owned the connection may already be gone.
+func (p *Pinger) Kill() error {
+	p.Tomb.Kill(nil)
+	err := p.Tomb.Wait()
 	p.conn.Delete(p.target.path, -1)
+	return err
 }
 
-// StartPinger creates and returns an active Pinger, refreshing the contents of
-// path every period nanoseconds.
-func StartPinger(conn *zk.Conn, path string, period time.Duration) (*Pinger, error) {
+// StartPinger creates and returns an active Pinger, refreshing the contents
+// of path every period nanoseconds. session is the SessionWatch returned
+// alongside conn by its backend's Dial-equivalent (see NewGozkConn and
+// NewZkConn); the Pinger subscribes to it so that it can stop writing as
+// soon as the underlying ZooKeeper session is lost, rather than continuing
+// to loop against a broken connection. Other consumers sharing the same
+// conn -- AliveW watches, a Watcher -- should subscribe independently;
+// session may be shared freely between them.
+func StartPinger(conn Conn, session *SessionWatch, path string, period time.Duration) (*Pinger, error) {
 	target := changeNode{conn, path, period.String()}
 	_, err := target.change()
 	if err != nil {
 		return nil, err
 	}
-	p := &Pinger{conn, target, period, make(chan bool)}
-	go p.run()
+	p := &Pinger{conn: conn, target: target, period: period, sessionSub: session.Subscribe()}
+	go p.loop()
 	return p, nil
 }
 
-// state holds information about a remote Pinger's state.
+// StartEphemeralPresence creates path as a node with the FlagEphemeral
+// create flag, and returns as soon as it has been created. Unlike
+// StartPinger, there is no write loop to drive and nothing to Close or
+// Kill: ZooKeeper itself ties the node's lifetime to conn's session,
+// removing it as soon as the session expires or is explicitly closed.
+// This avoids the write traffic a Pinger generates, and sidesteps
+// clock-drift entirely, at the cost of tying presence to a single live
+// connection rather than a periodically refreshed lease.
+func StartEphemeralPresence(conn Conn, path string) error {
+	_, err := conn.Create(path, "", FlagEphemeral)
+	return err
+}
+
+// state holds information about a remote Pinger's or ephemeral presence
+// node's state.
 type state struct {
-	path    string
-	alive   bool
-	timeout time.Duration
+	path      string
+	alive     bool
+	timeout   time.Duration
+	ephemeral bool
 }
 
-// newState gets the latest known state of a remote Pinger, given the mtime and
-// content of its target node. newState is *not* responsible for acquiring stat
-// and content itself, because its clients may or may not require a watch on the
-// node; however, conn is still required, so that a clock node can be created
-// and used to check staleness.
-func newState(conn *zk.Conn, path string, mtime time.Time, content string) (state, error) {
+// presenceState reports whether a presence node last written at mtime,
+// whose content describes its ping period, is still alive as of now. It
+// takes now as a parameter, rather than reading a clock node itself, so
+// that callers checking many nodes at once (see Watcher) can share a
+// single clock read across all of them instead of paying for one per
+// node.
+func presenceState(mtime time.Time, content string, now time.Time) (alive bool, timeout time.Duration, err error) {
+	period, err := time.ParseDuration(content)
+	if err != nil {
+		return false, 0, err
+	}
+	timeout = period * 2
+	alive = now.Sub(mtime) < timeout
+	return alive, timeout, nil
+}
+
+// newState gets the latest known state of a remote Pinger or ephemeral
+// presence node at path, given its stat and content. newState is *not*
+// responsible for acquiring stat and content itself, because its clients
+// may or may not require a watch on the node; however, conn is still
+// required, so that a clock node can be created and used to check
+// staleness.
+//
+// If stat shows the node to be ephemeral, it was created by
+// StartEphemeralPresence: its lifetime is bound to the ZooKeeper session
+// that owns it, so mere existence is enough to consider it alive, and the
+// mtime/clock-drift math below does not apply.
+func newState(conn Conn, path string, stat Stat, content string) (state, error) {
+	if stat.EphemeralOwner() != 0 {
+		return state{path: path, alive: true, ephemeral: true}, nil
+	}
 	clock := changeNode{conn, "/clock", ""}
 	now, err := clock.change()
 	if err != nil {
 		return state{}, err
 	}
-	delay := now.Sub(mtime)
-	period, err := time.ParseDuration(content)
+	alive, timeout, err := presenceState(stat.MTime(), content, now)
 	if err != nil {
-		err := fmt.Errorf("%s is not a valid presence node: %s", path, err)
-		return state{}, err
+		return state{}, fmt.Errorf("%s is not a valid presence node: %s", path, err)
 	}
-	timeout := period * 2
-	alive := delay < timeout
-	return state{path, alive, timeout}, nil
+	return state{path: path, alive: alive, timeout: timeout}, nil
 }
 
 // newStateW gets the latest known state of a remote Pinger targeting path, and
-// also returns a zookeeper watch which will fire on changes to the target node.
-func newStateW(conn *zk.Conn, path string) (s state, zkWatch <-chan zk.Event, err error) {
+// also returns a watch which will fire on changes to the target node.
+func newStateW(conn Conn, path string) (s state, zkWatch <-chan Event, err error) {
 	content, stat, zkWatch, err := conn.GetW(path)
-	if err == zk.ZNONODE {
+	if err == ErrNoNode {
 		stat, zkWatch, err = conn.ExistsW(path)
 		if err != nil {
 			return
@@ -129,33 +202,47 @@ func newStateW(conn *zk.Conn, path string) (s state, zkWatch <-chan zk.Event, er
 	} else if err != nil {
 		return
 	}
-	s, err = newState(conn, path, stat.MTime(), content)
+	s, err = newState(conn, path, stat, content)
 	return
 }
 
-// Alive returns whether a remote Pinger targeting path is alive.
-func Alive(conn *zk.Conn, path string) (bool, error) {
+// Alive returns whether a remote Pinger or ephemeral presence node
+// targeting path is alive.
+func Alive(conn Conn, path string) (bool, error) {
 	content, stat, err := conn.Get(path)
-	if err == zk.ZNONODE {
+	if err == ErrNoNode {
 		return false, nil
 	}
 	if err != nil {
 		return false, err
 	}
-	s, err := newState(conn, path, stat.MTime(), content)
+	s, err := newState(conn, path, stat, content)
 	if err != nil {
 		return false, err
 	}
 	return s.alive, err
 }
 
-// awaitDead sends false to watch when the node is deleted, or when it has
-// not been updated recently enough to still qualify as alive. It should only be
+// awaitDead sends false to watch when the node is deleted, when it has
+// not been updated recently enough to still qualify as alive (never the
+// case for an ephemeral node, whose death is always an EventDeleted
+// event), or when the connection's session is lost. It should only be
 // called when the node is known to be alive.
-func awaitDead(conn *zk.Conn, s state, zkWatch <-chan zk.Event, watch chan bool) {
+func awaitDead(conn Conn, sessionSub *Subscription, s state, zkWatch <-chan Event, watch chan bool) {
+	defer sessionSub.Close()
 	for s.alive {
+		var timeout <-chan time.Time
+		if !s.ephemeral {
+			timeout = time.After(s.timeout)
+		}
 		select {
-		case <-time.After(s.timeout):
+		case event, ok := <-sessionSub.Events():
+			if !ok || sessionLost(event) {
+				watch <- false
+				close(watch)
+				return
+			}
+		case <-timeout:
 			s.alive = false
 		case event := <-zkWatch:
 			if !event.Ok() {
@@ -163,9 +250,9 @@ func awaitDead(conn *zk.Conn, s state, zkWatch <-chan zk.Event, watch chan bool)
 				return
 			}
 			switch event.Type {
-			case zk.EVENT_DELETED:
+			case EventDeleted:
 				s.alive = false
-			case zk.EVENT_CHANGED:
+			case EventChanged:
 				var err error
 				s, zkWatch, err = newStateW(conn, s.path)
 				if err != nil {
@@ -178,26 +265,40 @@ func awaitDead(conn *zk.Conn, s state, zkWatch <-chan zk.Event, watch chan bool)
 	watch <- false
 }
 
-// awaitAlive sends true to watch when the node is changed or created. It should
-// only be called when the node is known to be dead.
-func awaitAlive(conn *zk.Conn, s state, zkWatch <-chan zk.Event, watch chan bool) {
+// awaitAlive sends true to watch when the node is changed or created. It
+// should only be called when the node is known to be dead. If the
+// connection's session is lost while waiting, awaitAlive gives up and
+// closes watch without sending, since the caller already knows the node
+// is dead and there is no longer any way to tell whether it has changed.
+func awaitAlive(conn Conn, sessionSub *Subscription, s state, zkWatch <-chan Event, watch chan bool) {
+	defer sessionSub.Close()
 	for !s.alive {
-		event := <-zkWatch
-		if !event.Ok() {
-			close(watch)
-			return
-		}
-		switch event.Type {
-		case zk.EVENT_CREATED, zk.EVENT_CHANGED:
-			s.alive = true
-		case zk.EVENT_DELETED:
-			// The pinger is still dead (just differently dead); start a new watch.
-			var err error
-			s, zkWatch, err = newStateW(conn, s.path)
-			if err != nil {
+		select {
+		case event, ok := <-sessionSub.Events():
+			if !ok || sessionLost(event) {
+				// The caller already knows the node is dead -- that's why
+				// awaitAlive was started -- so there is no change to
+				// report; just stop waiting.
+				close(watch)
+				return
+			}
+		case event := <-zkWatch:
+			if !event.Ok() {
 				close(watch)
 				return
 			}
+			switch event.Type {
+			case EventCreated, EventChanged:
+				s.alive = true
+			case EventDeleted:
+				// The pinger is still dead (just differently dead); start a new watch.
+				var err error
+				s, zkWatch, err = newStateW(conn, s.path)
+				if err != nil {
+					close(watch)
+					return
+				}
+			}
 		}
 	}
 	watch <- true
@@ -206,16 +307,23 @@ func awaitAlive(conn *zk.Conn, s state, zkWatch <-chan zk.Event, watch chan bool
 // AliveW returns whether the Pinger at the given node path seems to be alive.
 // It also returns a channel that will receive the new status when it changes.
 // If an error is encountered after AliveW returns, the channel will be closed.
-func AliveW(conn *zk.Conn, path string) (bool, <-chan bool, error) {
+// session is the SessionWatch returned alongside conn by its backend's
+// Dial-equivalent (see NewGozkConn and NewZkConn); AliveW subscribes to it
+// so that it can report death as soon as the ZooKeeper session is lost,
+// rather than waiting for the mtime-based timeout to elapse. session may
+// be shared freely with a Pinger, other AliveW calls, or a Watcher on the
+// same conn: each gets its own subscription, so all of them are told of
+// each session change.
+func AliveW(conn Conn, session *SessionWatch, path string) (bool, <-chan bool, error) {
 	s, zkWatch, err := newStateW(conn, path)
 	if err != nil {
 		return false, nil, err
 	}
 	watch := make(chan bool)
 	if s.alive {
-		go awaitDead(conn, s, zkWatch, watch)
+		go awaitDead(conn, session.Subscribe(), s, zkWatch, watch)
 	} else {
-		go awaitAlive(conn, s, zkWatch, watch)
+		go awaitAlive(conn, session.Subscribe(), s, zkWatch, watch)
 	}
 	return s.alive, watch, nil
 }
@@ -0,0 +1,181 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package presence_test
+
+import (
+	"testing"
+	"time"
+
+	szk "github.com/samuel/go-zookeeper/zk"
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/state/presence"
+	"launchpad.net/juju-core/state/presence/presencetest"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+const zkPort = 21812
+
+type presenceSuite struct {
+	server  *presencetest.Server
+	conn    presence.Conn
+	session *presence.SessionWatch
+}
+
+var _ = gc.Suite(&presenceSuite{})
+
+func (s *presenceSuite) SetUpTest(c *gc.C) {
+	server, err := presencetest.CreateServer(zkPort, c.MkDir())
+	c.Assert(err, gc.IsNil)
+	s.server = server
+
+	zkConn, zkSession, err := server.Dial(5 * time.Second)
+	c.Assert(err, gc.IsNil)
+	s.conn, s.session = presence.NewGozkConn(zkConn, zkSession)
+}
+
+func (s *presenceSuite) TearDownTest(c *gc.C) {
+	s.server.Destroy()
+}
+
+func (s *presenceSuite) TestPingerAliveW(c *gc.C) {
+	alive, err := presence.Alive(s.conn, "/pinger")
+	c.Assert(err, gc.IsNil)
+	c.Assert(alive, gc.Equals, false)
+
+	p, err := presence.StartPinger(s.conn, s.session, "/pinger", 50*time.Millisecond)
+	c.Assert(err, gc.IsNil)
+
+	alive, watch, err := presence.AliveW(s.conn, s.session, "/pinger")
+	c.Assert(err, gc.IsNil)
+	c.Assert(alive, gc.Equals, true)
+
+	c.Assert(p.Kill(), gc.IsNil)
+	select {
+	case alive := <-watch:
+		c.Assert(alive, gc.Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for AliveW to notice death")
+	}
+}
+
+func (s *presenceSuite) TestEphemeralPresence(c *gc.C) {
+	c.Assert(presence.StartEphemeralPresence(s.conn, "/ephemeral"), gc.IsNil)
+
+	alive, watch, err := presence.AliveW(s.conn, s.session, "/ephemeral")
+	c.Assert(err, gc.IsNil)
+	c.Assert(alive, gc.Equals, true)
+
+	c.Assert(s.conn.Delete("/ephemeral", -1), gc.IsNil)
+	select {
+	case alive := <-watch:
+		c.Assert(alive, gc.Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for AliveW to notice death")
+	}
+}
+
+func (s *presenceSuite) TestPingerSessionLoss(c *gc.C) {
+	p, err := presence.StartPinger(s.conn, s.session, "/pinger", 50*time.Millisecond)
+	c.Assert(err, gc.IsNil)
+
+	s.server.Destroy()
+
+	done := make(chan error, 1)
+	go func() { done <- p.Wait() }()
+	select {
+	case err := <-done:
+		c.Assert(err, gc.NotNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for Pinger to notice session loss")
+	}
+}
+
+func (s *presenceSuite) TestAliveWSessionLossWhileAlive(c *gc.C) {
+	_, err := presence.StartPinger(s.conn, s.session, "/pinger", 50*time.Millisecond)
+	c.Assert(err, gc.IsNil)
+
+	alive, watch, err := presence.AliveW(s.conn, s.session, "/pinger")
+	c.Assert(err, gc.IsNil)
+	c.Assert(alive, gc.Equals, true)
+
+	s.server.Destroy()
+	select {
+	case alive := <-watch:
+		c.Assert(alive, gc.Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for awaitDead to notice session loss")
+	}
+}
+
+func (s *presenceSuite) TestAliveWSessionLossWhileDead(c *gc.C) {
+	alive, watch, err := presence.AliveW(s.conn, s.session, "/pinger")
+	c.Assert(err, gc.IsNil)
+	c.Assert(alive, gc.Equals, false)
+
+	s.server.Destroy()
+	select {
+	case alive, ok := <-watch:
+		// awaitAlive already knows the node is dead, so session loss is
+		// reported by closing watch rather than by sending false again.
+		c.Assert(ok, gc.Equals, false)
+		c.Assert(alive, gc.Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for awaitAlive to notice session loss")
+	}
+}
+
+func (s *presenceSuite) TestAliveWNodeAppearsDuringRetry(c *gc.C) {
+	// newStateW reacts to ExistsW finding the node already present -- the
+	// "node *just* appeared" race -- by retrying GetW instead of reporting
+	// it as merely not-yet-alive. Creating the node concurrently with the
+	// AliveW call gives that race a real chance to happen, without
+	// depending on its exact timing for the test to be meaningful: either
+	// way, AliveW must eventually agree the node is alive.
+	done := make(chan error, 1)
+	go func() {
+		done <- presence.StartEphemeralPresence(s.conn, "/late")
+	}()
+
+	alive, watch, err := presence.AliveW(s.conn, s.session, "/late")
+	c.Assert(err, gc.IsNil)
+	c.Assert(<-done, gc.IsNil)
+
+	if !alive {
+		select {
+		case alive = <-watch:
+			c.Assert(alive, gc.Equals, true)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for AliveW to notice creation")
+		}
+	}
+}
+
+func (s *presenceSuite) TestSamuelBackend(c *gc.C) {
+	zkConn, zkSession, err := szk.Connect([]string{s.server.Addr()}, 5*time.Second)
+	c.Assert(err, gc.IsNil)
+	defer zkConn.Close()
+
+	conn, session := presence.NewZkConn(zkConn, zkSession)
+
+	alive, err := presence.Alive(conn, "/samuel-pinger")
+	c.Assert(err, gc.IsNil)
+	c.Assert(alive, gc.Equals, false)
+
+	p, err := presence.StartPinger(conn, session, "/samuel-pinger", 50*time.Millisecond)
+	c.Assert(err, gc.IsNil)
+
+	alive, watch, err := presence.AliveW(conn, session, "/samuel-pinger")
+	c.Assert(err, gc.IsNil)
+	c.Assert(alive, gc.Equals, true)
+
+	c.Assert(p.Kill(), gc.IsNil)
+	select {
+	case alive := <-watch:
+		c.Assert(alive, gc.Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for AliveW to notice death")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package presencetest provides a real, disposable ZooKeeper server for
+// exercising the presence package against. Much of the Pinger/AliveW
+// logic lives in timing-sensitive branches -- the session races in
+// newStateW, the "node *just* appeared" retry, awaitDead versus
+// awaitAlive -- that can only be exercised meaningfully end to end,
+// against a real server, rather than mocked out.
+package presencetest
+
+import (
+	"time"
+
+	zk "launchpad.net/gozk/zookeeper"
+)
+
+// Server is a ZooKeeper instance running for the extent of a test.
+type Server struct {
+	zk        *zk.Server
+	destroyed bool
+}
+
+// CreateServer starts a new ZooKeeper instance listening on port, using
+// dataDir (typically a fresh directory obtained from a test's c.MkDir())
+// for its state, and returns once it is ready to accept connections.
+func CreateServer(port int, dataDir string) (*Server, error) {
+	zkServer, err := zk.CreateServer(port, dataDir, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := zkServer.Start(); err != nil {
+		return nil, err
+	}
+	return &Server{zk: zkServer}, nil
+}
+
+// Destroy shuts the server down. It is safe to call more than once -- a
+// test exercising session loss may destroy the server itself, ahead of
+// the teardown that destroys it again.
+func (s *Server) Destroy() {
+	if s.destroyed {
+		return
+	}
+	s.destroyed = true
+	s.zk.Destroy()
+}
+
+// Addr returns the "host:port" address the server listens on.
+func (s *Server) Addr() string {
+	return s.zk.Addr()
+}
+
+// Dial connects to s and returns the resulting connection along with the
+// session-event channel gozk.Dial returns alongside it. Pass both to
+// presence.NewGozkConn to obtain a presence.Conn.
+func (s *Server) Dial(timeout time.Duration) (*zk.Conn, <-chan zk.Event, error) {
+	return zk.Dial(s.Addr(), timeout)
+}
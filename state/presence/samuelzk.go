@@ -0,0 +1,143 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package presence
+
+import (
+	"time"
+
+	szk "github.com/samuel/go-zookeeper/zk"
+)
+
+// NewZkConn adapts conn, and the session-event channel returned alongside
+// it by szk.Connect, to the Conn interface, returning a SessionWatch that
+// every consumer sharing conn can subscribe to in its own right. It lets
+// presence run against github.com/samuel/go-zookeeper/zk, as an
+// alternative to the unmaintained launchpad.net/gozk bindings used by
+// NewGozkConn.
+func NewZkConn(conn *szk.Conn, nativeSession <-chan szk.Event) (Conn, *SessionWatch) {
+	translated := make(chan Event)
+	go func() {
+		defer close(translated)
+		for ev := range nativeSession {
+			translated <- szkEvent(ev)
+		}
+	}()
+	return szkConn{conn}, newSessionWatch(translated)
+}
+
+type szkConn struct {
+	conn *szk.Conn
+}
+
+func (c szkConn) Get(path string) (string, Stat, error) {
+	data, stat, err := c.conn.Get(path)
+	return string(data), szkStatOrNil(stat), szkErr(err)
+}
+
+func (c szkConn) GetW(path string) (string, Stat, <-chan Event, error) {
+	data, stat, zkWatch, err := c.conn.GetW(path)
+	return string(data), szkStatOrNil(stat), szkWatch(zkWatch), szkErr(err)
+}
+
+func (c szkConn) ExistsW(path string) (Stat, <-chan Event, error) {
+	exists, stat, zkWatch, err := c.conn.ExistsW(path)
+	if err != nil {
+		return nil, nil, szkErr(err)
+	}
+	if !exists {
+		return nil, szkWatch(zkWatch), nil
+	}
+	return szkStatOrNil(stat), szkWatch(zkWatch), nil
+}
+
+func (c szkConn) Set(path, content string, version int32) (Stat, error) {
+	stat, err := c.conn.Set(path, []byte(content), version)
+	return szkStatOrNil(stat), szkErr(err)
+}
+
+func (c szkConn) Create(path, content string, flags int32) (string, error) {
+	newPath, err := c.conn.Create(path, []byte(content), flags, szk.WorldACL(szk.PermAll))
+	return newPath, szkErr(err)
+}
+
+func (c szkConn) Delete(path string, version int32) error {
+	return szkErr(c.conn.Delete(path, version))
+}
+
+// szkStat adapts a *szk.Stat to the Stat interface; szk represents
+// timestamps as milliseconds since the epoch rather than time.Time.
+type szkStat struct {
+	stat *szk.Stat
+}
+
+func (s szkStat) MTime() time.Time {
+	return time.Unix(0, int64(s.stat.Mtime)*int64(time.Millisecond))
+}
+
+func (s szkStat) EphemeralOwner() int64 {
+	return s.stat.EphemeralOwner
+}
+
+// szkStatOrNil wraps stat in a szkStat, unless stat itself is nil, in
+// which case it returns a nil Stat rather than a non-nil interface
+// wrapping a nil pointer.
+func szkStatOrNil(stat *szk.Stat) Stat {
+	if stat == nil {
+		return nil
+	}
+	return szkStat{stat}
+}
+
+// szkWatch adapts a single-fire szk watch channel to one delivering
+// presence Events. watch is given a buffer of 1 so that the goroutine
+// below can deliver its one event and exit even if presence abandons the
+// watch without ever reading it -- as it does on the "node *just*
+// appeared" retry in newStateW -- rather than leaking forever on an
+// unbuffered send nobody is there to receive.
+func szkWatch(zkWatch <-chan szk.Event) <-chan Event {
+	if zkWatch == nil {
+		return nil
+	}
+	watch := make(chan Event, 1)
+	go func() {
+		defer close(watch)
+		for ev := range zkWatch {
+			watch <- szkEvent(ev)
+		}
+	}()
+	return watch
+}
+
+func szkEvent(ev szk.Event) Event {
+	e := Event{}
+	switch ev.Type {
+	case szk.EventNodeCreated:
+		e.Type = EventCreated
+	case szk.EventNodeDataChanged:
+		e.Type = EventChanged
+	case szk.EventNodeDeleted:
+		e.Type = EventDeleted
+	case szk.EventSession:
+		e.Type = EventSession
+	}
+	switch ev.State {
+	case szk.StateConnecting:
+		e.State = SessionConnecting
+	case szk.StateExpired:
+		e.State = SessionExpired
+	default:
+		e.State = SessionConnected
+	}
+	return e
+}
+
+func szkErr(err error) error {
+	switch err {
+	case szk.ErrNoNode:
+		return ErrNoNode
+	case szk.ErrNodeExists:
+		return ErrNodeExists
+	}
+	return err
+}
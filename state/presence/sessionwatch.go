@@ -0,0 +1,107 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package presence
+
+import "sync"
+
+// SessionWatch fans a connection's session-event stream out to any number
+// of independent subscribers. NewGozkConn and NewZkConn each return one
+// alongside the Conn they adapt. A single connection is commonly shared by
+// a Pinger, one or more AliveW watches, and a Watcher; since a plain Go
+// channel delivers each value to exactly one receiver, handing all of
+// them the same raw channel would mean a lost session is only ever
+// reported to whichever one happens to read it first. Subscribe gives
+// each consumer its own channel, so every one of them is told of each
+// session change; one that is not reading when several events arrive
+// sees only the latest of them.
+type SessionWatch struct {
+	mu     sync.Mutex
+	subs   map[chan Event]bool
+	closed bool
+}
+
+// newSessionWatch starts fanning out the events read from native, and
+// returns a SessionWatch that can be subscribed to. It takes ownership of
+// native; nothing else should read from it.
+func newSessionWatch(native <-chan Event) *SessionWatch {
+	w := &SessionWatch{subs: make(map[chan Event]bool)}
+	go w.loop(native)
+	return w
+}
+
+func (w *SessionWatch) loop(native <-chan Event) {
+	for event := range native {
+		w.mu.Lock()
+		for sub := range w.subs {
+			// sub is buffered (see Subscribe), so this never blocks: if
+			// it's full, drop the stale pending event first and replace
+			// it with this one. A subscriber that isn't reading right
+			// now -- newStateW's network round-trips, a blocked send on
+			// its own watch channel -- must never stall delivery to the
+			// others, and will still see the latest event once it looks.
+			select {
+			case sub <- event:
+			default:
+				select {
+				case <-sub:
+				default:
+				}
+				sub <- event
+			}
+		}
+		w.mu.Unlock()
+	}
+	w.mu.Lock()
+	w.closed = true
+	for sub := range w.subs {
+		close(sub)
+	}
+	w.subs = nil
+	w.mu.Unlock()
+}
+
+// Subscribe returns a Subscription that receives the session events seen
+// from now on. Its channel is buffered and never blocks the broadcast, so
+// a subscriber that is busy elsewhere -- blocked in a network round-trip,
+// say -- cannot stall delivery to the others; it simply sees the latest
+// event once it next reads, rather than every one in between.
+func (w *SessionWatch) Subscribe() *Subscription {
+	ch := make(chan Event, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		close(ch)
+		return &Subscription{events: ch}
+	}
+	w.subs[ch] = true
+	return &Subscription{watch: w, events: ch}
+}
+
+// Subscription is a single consumer's view of a SessionWatch's events.
+type Subscription struct {
+	watch  *SessionWatch
+	events chan Event
+}
+
+// Events returns the channel on which this subscription's session events
+// are delivered. It is closed once the underlying connection's event
+// stream ends, or after Close.
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Close stops delivering events to this subscription, letting the
+// SessionWatch forget about it.
+func (sub *Subscription) Close() {
+	if sub.watch == nil {
+		return
+	}
+	w := sub.watch
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed && w.subs[sub.events] {
+		delete(w.subs, sub.events)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package presence
+
+import (
+	"fmt"
+	"time"
+
+	"launchpad.net/tomb"
+)
+
+// PresenceChange describes a change in liveness for a single path watched
+// by a Watcher.
+type PresenceChange struct {
+	Path  string
+	Alive bool
+}
+
+// watchedPath holds a Watcher's last-known view of a single watched node.
+// mtime and timeout are meaningless (and ignored) when ephemeral is true.
+// done is closed by Remove to stop the forward goroutine rearm started for
+// this path, so that removing a path that never fires its watch doesn't
+// leak a goroutine until the whole Watcher stops.
+type watchedPath struct {
+	alive     bool
+	ephemeral bool
+	mtime     time.Time
+	timeout   time.Duration
+	done      chan struct{}
+}
+
+// pathEvent tags an Event with the path whose watch produced it, so that
+// per-path forwarder goroutines (see Watcher.forward) can report back to
+// the single goroutine that owns all of a Watcher's state.
+type pathEvent struct {
+	path  string
+	event Event
+}
+
+// Watcher multiplexes watches on an arbitrary, dynamically changing set of
+// presence nodes onto a single goroutine. Unlike calling AliveW once per
+// path, it shares one clock-node write per tick across every watched path,
+// rather than paying for a clock write every time any one of them might
+// have gone stale; this is the difference that lets it scale to watching
+// thousands of paths at once.
+type Watcher struct {
+	tomb.Tomb
+	conn       Conn
+	session    *SessionWatch
+	period     time.Duration
+	add        chan string
+	remove     chan string
+	pathEvents chan pathEvent
+	events     chan PresenceChange
+}
+
+// NewWatcher returns a running Watcher that checks the paths added to it
+// with Add for staleness every period, sharing a single clock-node write
+// across all of them on each check. session is the SessionWatch returned
+// alongside conn by its backend's Dial-equivalent (see NewGozkConn and
+// NewZkConn); it may be shared freely with a Pinger, AliveW watches, or
+// other Watchers on the same conn, since each subscribes independently.
+func NewWatcher(conn Conn, session *SessionWatch, period time.Duration) *Watcher {
+	w := &Watcher{
+		conn:       conn,
+		session:    session,
+		period:     period,
+		add:        make(chan string),
+		remove:     make(chan string),
+		pathEvents: make(chan pathEvent),
+		events:     make(chan PresenceChange),
+	}
+	go w.loop()
+	return w
+}
+
+// Add starts watching path, if it is not being watched already. The
+// current liveness of path is delivered on Events as soon as it is known.
+func (w *Watcher) Add(path string) {
+	select {
+	case w.add <- path:
+	case <-w.Dying():
+	}
+}
+
+// Remove stops watching path. No further changes for path will be
+// delivered on Events.
+func (w *Watcher) Remove(path string) {
+	select {
+	case w.remove <- path:
+	case <-w.Dying():
+	}
+}
+
+// Events returns the channel on which liveness changes for watched paths
+// are delivered. It is closed when the Watcher stops, whether via Stop or
+// because its connection's session was lost.
+func (w *Watcher) Events() <-chan PresenceChange {
+	return w.events
+}
+
+// Stop shuts down the Watcher and returns any error that caused it to
+// stop running on its own, such as a lost session.
+func (w *Watcher) Stop() error {
+	w.Tomb.Kill(nil)
+	return w.Tomb.Wait()
+}
+
+// loop is the Watcher's single goroutine. It owns every watchedPath, and
+// is the only place that reads or writes them, so that adding paths,
+// removing paths, handling their individual watch events, and sharing one
+// clock-node read across all of them on each tick never race with each
+// other.
+func (w *Watcher) loop() {
+	defer close(w.events)
+	defer w.Done()
+	sessionSub := w.session.Subscribe()
+	defer sessionSub.Close()
+	clock := changeNode{w.conn, "/clock", ""}
+	now, err := clock.change()
+	if err != nil {
+		w.Kill(err)
+		return
+	}
+	paths := make(map[string]*watchedPath)
+	tick := time.NewTicker(w.period)
+	defer tick.Stop()
+	for {
+		select {
+		case <-w.Dying():
+			return
+		case event, ok := <-sessionSub.Events():
+			if !ok || sessionLost(event) {
+				w.Kill(fmt.Errorf("presence: zookeeper session lost: %v", event))
+				return
+			}
+		case path := <-w.add:
+			if _, ok := paths[path]; ok {
+				continue
+			}
+			// A newly added path needs its liveness checked against the
+			// clock as of right now, not as of the last tick (which may
+			// be up to period stale), so give it its own fresh read.
+			addedNow, err := clock.change()
+			if err != nil {
+				w.Kill(err)
+				return
+			}
+			wp, err := w.rearm(path, addedNow)
+			if err != nil {
+				w.Kill(err)
+				return
+			}
+			paths[path] = wp
+			w.notify(path, wp.alive)
+		case path := <-w.remove:
+			if wp, ok := paths[path]; ok {
+				close(wp.done)
+				delete(paths, path)
+			}
+		case pe := <-w.pathEvents:
+			old, ok := paths[pe.path]
+			if !ok {
+				// Already removed; ignore the stale watch firing.
+				continue
+			}
+			if !pe.event.Ok() {
+				w.Kill(fmt.Errorf("presence: watch on %s failed: %v", pe.path, pe.event))
+				return
+			}
+			wp, err := w.rearm(pe.path, now)
+			if err != nil {
+				w.Kill(err)
+				return
+			}
+			paths[pe.path] = wp
+			if wp.alive != old.alive {
+				w.notify(pe.path, wp.alive)
+			}
+		case <-tick.C:
+			now, err = clock.change()
+			if err != nil {
+				w.Kill(err)
+				return
+			}
+			for path, wp := range paths {
+				if wp.ephemeral || !wp.alive {
+					continue
+				}
+				if now.Sub(wp.mtime) >= wp.timeout {
+					wp.alive = false
+					w.notify(path, false)
+				}
+			}
+		}
+	}
+}
+
+// rearm (re)establishes a watch on path, and returns the watchedPath
+// reflecting its state as of now. It arranges for any future change to be
+// relayed back to loop via w.pathEvents, and gives the watchedPath a done
+// channel that Remove can close to stop that relay early.
+func (w *Watcher) rearm(path string, now time.Time) (*watchedPath, error) {
+	content, stat, zkWatch, err := w.conn.GetW(path)
+	if err == ErrNoNode {
+		stat, zkWatch, err = w.conn.ExistsW(path)
+		if err != nil {
+			return nil, err
+		}
+		if stat != nil {
+			// Whoops, node *just* appeared. Try again.
+			return w.rearm(path, now)
+		}
+		done := make(chan struct{})
+		go w.forward(path, zkWatch, done)
+		return &watchedPath{done: done}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go w.forward(path, zkWatch, done)
+	if stat.EphemeralOwner() != 0 {
+		return &watchedPath{alive: true, ephemeral: true, done: done}, nil
+	}
+	alive, timeout, err := presenceState(stat.MTime(), content, now)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid presence node: %s", path, err)
+	}
+	return &watchedPath{alive: alive, mtime: stat.MTime(), timeout: timeout, done: done}, nil
+}
+
+// forward waits for the single event that will arrive on zkWatch -- the
+// one-shot channel returned by a GetW or ExistsW call -- and relays it to
+// loop tagged with path. Keeping this wait in its own goroutine is what
+// lets loop multiplex an arbitrary number of watched paths without a
+// select case per path. It gives up without relaying anything if done is
+// closed first, which Remove does for a path whose watch never fires, so
+// that removing it doesn't leak this goroutine until the Watcher stops.
+func (w *Watcher) forward(path string, zkWatch <-chan Event, done <-chan struct{}) {
+	select {
+	case event := <-zkWatch:
+		select {
+		case w.pathEvents <- pathEvent{path, event}:
+		case <-done:
+		case <-w.Dying():
+		}
+	case <-done:
+	case <-w.Dying():
+	}
+}
+
+// notify sends a PresenceChange on w.events, giving up if the Watcher is
+// shutting down.
+func (w *Watcher) notify(path string, alive bool) {
+	select {
+	case w.events <- PresenceChange{path, alive}:
+	case <-w.Dying():
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package presence_test
+
+import (
+	"time"
+
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/state/presence"
+)
+
+// nextChange waits up to five seconds for a PresenceChange on w, failing
+// the test if none arrives.
+func nextChange(c *gc.C, w *presence.Watcher) presence.PresenceChange {
+	select {
+	case change, ok := <-w.Events():
+		c.Assert(ok, gc.Equals, true)
+		return change
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for a PresenceChange")
+	}
+	panic("unreachable")
+}
+
+// assertNoChange fails the test if a PresenceChange arrives on w before a
+// short grace period elapses.
+func assertNoChange(c *gc.C, w *presence.Watcher) {
+	select {
+	case change, ok := <-w.Events():
+		c.Fatalf("unexpected change (ok=%v): %#v", ok, change)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func (s *presenceSuite) TestWatcherAddRemove(c *gc.C) {
+	c.Assert(presence.StartEphemeralPresence(s.conn, "/ephemeral"), gc.IsNil)
+
+	w := presence.NewWatcher(s.conn, s.session, 50*time.Millisecond)
+	defer w.Stop()
+
+	w.Add("/ephemeral")
+	change := nextChange(c, w)
+	c.Assert(change, gc.Equals, presence.PresenceChange{Path: "/ephemeral", Alive: true})
+
+	// Adding the same path again must not produce a second notification.
+	w.Add("/ephemeral")
+	assertNoChange(c, w)
+
+	w.Remove("/ephemeral")
+	assertNoChange(c, w)
+
+	c.Assert(s.conn.Delete("/ephemeral", -1), gc.IsNil)
+	assertNoChange(c, w)
+}
+
+func (s *presenceSuite) TestWatcherNotYetCreated(c *gc.C) {
+	w := presence.NewWatcher(s.conn, s.session, 50*time.Millisecond)
+	defer w.Stop()
+
+	w.Add("/ephemeral")
+	change := nextChange(c, w)
+	c.Assert(change, gc.Equals, presence.PresenceChange{Path: "/ephemeral", Alive: false})
+
+	c.Assert(presence.StartEphemeralPresence(s.conn, "/ephemeral"), gc.IsNil)
+	change = nextChange(c, w)
+	c.Assert(change, gc.Equals, presence.PresenceChange{Path: "/ephemeral", Alive: true})
+}
+
+func (s *presenceSuite) TestWatcherEventDeleted(c *gc.C) {
+	c.Assert(presence.StartEphemeralPresence(s.conn, "/ephemeral"), gc.IsNil)
+
+	w := presence.NewWatcher(s.conn, s.session, 50*time.Millisecond)
+	defer w.Stop()
+
+	w.Add("/ephemeral")
+	change := nextChange(c, w)
+	c.Assert(change, gc.Equals, presence.PresenceChange{Path: "/ephemeral", Alive: true})
+
+	c.Assert(s.conn.Delete("/ephemeral", -1), gc.IsNil)
+	change = nextChange(c, w)
+	c.Assert(change, gc.Equals, presence.PresenceChange{Path: "/ephemeral", Alive: false})
+}
+
+func (s *presenceSuite) TestWatcherSharedClockTick(c *gc.C) {
+	p1, err := presence.StartPinger(s.conn, s.session, "/pinger1", 20*time.Millisecond)
+	c.Assert(err, gc.IsNil)
+	p2, err := presence.StartPinger(s.conn, s.session, "/pinger2", 20*time.Millisecond)
+	c.Assert(err, gc.IsNil)
+
+	w := presence.NewWatcher(s.conn, s.session, 20*time.Millisecond)
+	defer w.Stop()
+
+	w.Add("/pinger1")
+	w.Add("/pinger2")
+	seen := make(map[string]bool)
+	for len(seen) < 2 {
+		change := nextChange(c, w)
+		c.Assert(change.Alive, gc.Equals, true)
+		seen[change.Path] = true
+	}
+
+	// Stopping both Pingers at the same time lets their nodes go stale on
+	// the same tick, exercising the clock read the Watcher shares across
+	// every path it watches rather than reading it once per path.
+	c.Assert(p1.Close(), gc.IsNil)
+	c.Assert(p2.Close(), gc.IsNil)
+
+	seen = make(map[string]bool)
+	for len(seen) < 2 {
+		change := nextChange(c, w)
+		c.Assert(change.Alive, gc.Equals, false)
+		seen[change.Path] = true
+	}
+}
+
+func (s *presenceSuite) TestWatcherSessionLoss(c *gc.C) {
+	c.Assert(presence.StartEphemeralPresence(s.conn, "/ephemeral"), gc.IsNil)
+
+	w := presence.NewWatcher(s.conn, s.session, 50*time.Millisecond)
+	w.Add("/ephemeral")
+	c.Assert(nextChange(c, w), gc.Equals, presence.PresenceChange{Path: "/ephemeral", Alive: true})
+
+	s.server.Destroy()
+
+	done := make(chan error, 1)
+	go func() { done <- w.Stop() }()
+	select {
+	case err := <-done:
+		c.Assert(err, gc.NotNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for Watcher to notice session loss")
+	}
+
+	_, ok := <-w.Events()
+	c.Assert(ok, gc.Equals, false)
+}
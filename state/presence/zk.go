@@ -0,0 +1,115 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package presence
+
+import (
+	"errors"
+	"time"
+)
+
+// Conn is the subset of a ZooKeeper client connection that presence
+// depends on. It exists so that presence can run against more than one
+// underlying client library -- see NewGozkConn and NewZkConn -- without
+// any of the Pinger/AliveW logic needing to change.
+type Conn interface {
+	// Get returns the content and Stat of the node at path.
+	Get(path string) (content string, stat Stat, err error)
+
+	// GetW is like Get, but also returns a channel that receives a single
+	// Event the next time the node at path is changed or deleted.
+	GetW(path string) (content string, stat Stat, watch <-chan Event, err error)
+
+	// ExistsW checks for the existence of the node at path, returning its
+	// Stat if it exists (nil otherwise), and a channel that receives a
+	// single Event the next time the node at path is created, changed, or
+	// deleted.
+	ExistsW(path string) (stat Stat, watch <-chan Event, err error)
+
+	// Set replaces the content of the node at path and returns its new
+	// Stat. version is a compare-and-swap guard; -1 disables the check.
+	Set(path, content string, version int32) (stat Stat, err error)
+
+	// Create creates the node at path with the given content and flags
+	// (e.g. FlagEphemeral), world-readable and world-writable, and
+	// returns the path of the node actually created.
+	Create(path, content string, flags int32) (string, error)
+
+	// Delete removes the node at path. version is a compare-and-swap
+	// guard; -1 disables the check.
+	Delete(path string, version int32) error
+}
+
+// Stat holds the subset of ZooKeeper node metadata that presence needs.
+type Stat interface {
+	// MTime returns the node's last-modified time.
+	MTime() time.Time
+
+	// EphemeralOwner returns the session id that owns the node, or 0 if
+	// the node is not ephemeral.
+	EphemeralOwner() int64
+}
+
+// ErrNoNode is returned by Conn methods in place of any backend-specific
+// "no such node" error.
+var ErrNoNode = errors.New("presence: no such node")
+
+// ErrNodeExists is returned by Conn.Create in place of any
+// backend-specific "node already exists" error.
+var ErrNodeExists = errors.New("presence: node already exists")
+
+// Node creation flags, passed to Conn.Create.
+const (
+	// FlagEphemeral ties the lifetime of the created node to the session
+	// that created it; see StartEphemeralPresence.
+	FlagEphemeral int32 = 1 << iota
+
+	// FlagSequence appends a monotonically increasing, server-assigned
+	// suffix to the node's name.
+	FlagSequence
+)
+
+// EventType identifies what kind of change an Event represents.
+type EventType int32
+
+const (
+	EventChanged EventType = iota
+	EventCreated
+	EventDeleted
+
+	// EventSession indicates a change in the state of the connection's
+	// session, rather than of any particular node. It is delivered both
+	// to the subscriptions of the SessionWatch returned alongside a Conn,
+	// and, as ZooKeeper
+	// clients generally do not distinguish the two, may also be seen
+	// interleaved on a node's watch channel.
+	EventSession
+)
+
+// SessionState identifies the state of a ZooKeeper session, and is only
+// meaningful on an Event of type EventSession.
+type SessionState int32
+
+const (
+	SessionConnected SessionState = iota
+	SessionConnecting
+	SessionExpired
+)
+
+// Event is delivered on the watch channels returned by a Conn's GetW and
+// ExistsW methods, and to the subscriptions of the SessionWatch returned
+// alongside a Conn, in a form independent of the underlying ZooKeeper
+// client library.
+type Event struct {
+	Type  EventType
+	State SessionState
+}
+
+// Ok reports whether the event carries usable information. It is false
+// for an EventSession event that reports the session as no longer
+// connected, which is the signal that any other information derived from
+// the connection -- including other pending watches -- can no longer be
+// trusted.
+func (e Event) Ok() bool {
+	return e.Type != EventSession || e.State == SessionConnected
+}